@@ -2,19 +2,39 @@ package jsonpatcher
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
 	jsonpatch "github.com/evanphx/json-patch"
+	cid "github.com/ipfs/go-cid"
 	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
 	cbornode "github.com/ipfs/go-ipld-cbor"
 	ipldformat "github.com/ipfs/go-ipld-format"
 	logging "github.com/ipfs/go-log"
+	crypto "github.com/libp2p/go-libp2p-core/crypto"
 	"github.com/multiformats/go-multihash"
 	core "github.com/textileio/go-textile-core/store"
+	jsondiff "github.com/wI2L/jsondiff"
+	gojsonschema "github.com/xeipuuv/gojsonschema"
+)
+
+// PatchFormat selects the JSON patch flavor produced by saveEvent and
+// understood by Reduce. MergePatch (RFC 7396) is simpler but can't express
+// array element removal, precise index inserts, or test/move/copy ops;
+// JSONPatch (RFC 6902) can.
+type PatchFormat int
+
+const (
+	MergePatch PatchFormat = iota
+	JSONPatch
 )
 
 type operationType int
@@ -23,6 +43,10 @@ const (
 	create operationType = iota
 	save
 	delete
+	// snapshot carries an entity's full serialized state as of some
+	// logical time, so Reduce can short-circuit replay instead of
+	// reapplying every preceding create/save/delete.
+	snapshot
 )
 
 var (
@@ -30,16 +54,125 @@ var (
 	errSavingNonExistentInstance  = errors.New("can't save nonexistent instance")
 	errCantCreateExistingInstance = errors.New("cant't create already existent instance")
 	errUnknownOperation           = errors.New("unknown operation type")
+	errInvalidSignature           = errors.New("event signature doesn't verify against its author")
+	errUnauthorizedAuthor         = errors.New("event author isn't allowed by the ACL")
+	errUnsignedEvent              = errors.New("event has no author/signature, but this codec requires one")
 )
 
+// ACLChecker decides whether the given author (its public key bytes) is
+// allowed to emit events for the given model/entity. It's supplied by the
+// caller and consulted by Reduce for every signed event.
+type ACLChecker func(author []byte, modelName string, entityID core.EntityID) bool
+
 type operation struct {
 	Type      operationType
 	EntityID  core.EntityID
 	JSONPatch []byte
+	Format    PatchFormat // format of JSONPatch for save ops; zero value (MergePatch) for create/delete
+	Author    []byte      // marshaled libp2p public key of the operation's author, nil when unsigned
+	Sig       []byte      // signature of Author+ModelName+ID+Type+Format+EntityID+JSONPatch+Timestamp, nil when unsigned
 }
 
 type jsonPatcher struct {
-	jsonMode bool
+	jsonMode    bool
+	patchFormat PatchFormat
+	privKey     crypto.PrivKey
+	acl         ACLChecker
+	schemas     map[string]*gojsonschema.Schema
+
+	conflictsMu sync.Mutex
+	conflicts   []Conflict
+}
+
+// ErrSchemaViolation is returned when a document fails validation against
+// the JSON Schema registered for its model.
+type ErrSchemaViolation struct {
+	Model  string
+	Errors []string
+}
+
+func (e *ErrSchemaViolation) Error() string {
+	return fmt.Sprintf("document violates schema for model %q: %s", e.Model, strings.Join(e.Errors, "; "))
+}
+
+// RegisterSchema associates a JSON Schema (draft-7 / 2020-12) with
+// modelName. createEvent and saveEvent validate documents of that model
+// against it before packing an event, and Reduce re-validates after
+// applying a peer's patch, so a corrupting patch never lands in the
+// datastore.
+func (jp *jsonPatcher) RegisterSchema(modelName string, schema []byte) error {
+	s, err := gojsonschema.NewSchema(gojsonschema.NewBytesLoader(schema))
+	if err != nil {
+		return fmt.Errorf("compiling schema for model %q: %v", modelName, err)
+	}
+	if jp.schemas == nil {
+		jp.schemas = make(map[string]*gojsonschema.Schema)
+	}
+	jp.schemas[modelName] = s
+	return nil
+}
+
+// validate checks doc against the schema registered for modelName, if
+// any. It's a no-op when no schema was registered for that model.
+func (jp *jsonPatcher) validate(modelName string, doc []byte) error {
+	schema, ok := jp.schemas[modelName]
+	if !ok {
+		return nil
+	}
+	result, err := schema.Validate(gojsonschema.NewBytesLoader(doc))
+	if err != nil {
+		return fmt.Errorf("validating document for model %q: %v", modelName, err)
+	}
+	if !result.Valid() {
+		errs := make([]string, len(result.Errors()))
+		for i, re := range result.Errors() {
+			errs[i] = re.String()
+		}
+		return &ErrSchemaViolation{Model: modelName, Errors: errs}
+	}
+	return nil
+}
+
+// ConflictType identifies how Reduce resolved a set of concurrent events
+// for the same (Model, EntityID).
+type ConflictType int
+
+const (
+	// ConflictConcurrentCreate is two or more concurrent create events;
+	// resolved by keeping the lexicographically smallest payload.
+	ConflictConcurrentCreate ConflictType = iota
+	// ConflictDeleteWins is a concurrent delete and save; the delete wins.
+	ConflictDeleteWins
+	// ConflictFieldMerge is two or more concurrent saves; resolved by
+	// applying them sequentially in deterministic (Timestamp, CID) order,
+	// so the last one wins per field. They are not three-way merged
+	// against a common ancestor.
+	ConflictFieldMerge
+)
+
+// Conflict records that Reduce had to reconcile concurrent branches of the
+// DAG for a single entity. go-textile-core's ReduceAction can't be extended
+// from this package, so conflicts are surfaced out-of-band via Conflicts
+// rather than embedded in the returned []core.ReduceAction.
+type Conflict struct {
+	Model     string
+	EntityID  core.EntityID
+	Type      ConflictType
+	Discarded []cid.Cid // CIDs of the events that lost the resolution
+}
+
+// Conflicts returns the conflicts resolved by the most recently completed
+// call to Reduce. It's a side channel — go-textile-core's ReduceAction
+// can't be extended from this package — and inherits that side channel's
+// limitation: if the codec's Reduce is called concurrently from more than
+// one goroutine, a caller reading Conflicts() can't tell which of those
+// calls it's seeing the result of, or race a Reduce that's still running.
+// conflictsMu only protects the field itself from concurrent access; it
+// doesn't give callers per-call attribution.
+func (jp *jsonPatcher) Conflicts() []Conflict {
+	jp.conflictsMu.Lock()
+	defer jp.conflictsMu.Unlock()
+	return jp.conflicts
 }
 
 var _ core.EventCodec = (*jsonPatcher)(nil)
@@ -51,22 +184,38 @@ func init() {
 	cbornode.RegisterCborType(time.Time{})
 }
 
-// New returns a JSON-Patcher EventCodec
-func New(jsonMode bool) core.EventCodec {
-	return &jsonPatcher{jsonMode: jsonMode}
+// New returns a JSON-Patcher EventCodec. patchFormat selects whether save
+// events are encoded as RFC 7396 Merge Patch or RFC 6902 JSON Patch.
+func New(jsonMode bool, patchFormat PatchFormat) core.EventCodec {
+	return &jsonPatcher{jsonMode: jsonMode, patchFormat: patchFormat}
+}
+
+// NewSigned returns a JSON-Patcher EventCodec that signs every event it
+// creates with privKey, and verifies the signature and author of every
+// event it reduces.
+func NewSigned(privKey crypto.PrivKey, jsonMode bool, patchFormat PatchFormat) core.EventCodec {
+	return &jsonPatcher{jsonMode: jsonMode, patchFormat: patchFormat, privKey: privKey}
+}
+
+// SetACL installs the ACLChecker consulted by Reduce to authorize the
+// author of signed events. Once an ACL is installed, Reduce rejects any
+// event without an author (errUnsignedEvent), since there's no author to
+// check.
+func (jp *jsonPatcher) SetACL(acl ACLChecker) {
+	jp.acl = acl
 }
 
 func (jp *jsonPatcher) Create(actions []core.Action) ([]core.Event, ipldformat.Node, error) {
-	revents := recordEvents{Patches: make([]patchEvent, len(actions))}
+	revents := recordEvents{CodecVersion: codecVersion, Patches: make([]patchEvent, len(actions))}
 	events := make([]core.Event, len(actions))
 	for i := range actions {
 		var op *operation
 		var err error
 		switch actions[i].Type {
 		case core.Create:
-			op, err = createEvent(actions[i].EntityID, actions[i].Current, jp.jsonMode)
+			op, err = jp.createEvent(actions[i].ModelName, actions[i].EntityID, actions[i].Current)
 		case core.Save:
-			op, err = saveEvent(actions[i].EntityID, actions[i].Previous, actions[i].Current, jp.jsonMode)
+			op, err = jp.saveEvent(actions[i].ModelName, actions[i].EntityID, actions[i].Previous, actions[i].Current)
 		case core.Delete:
 			op, err = deleteEvent(actions[i].EntityID)
 		default:
@@ -75,12 +224,18 @@ func (jp *jsonPatcher) Create(actions []core.Action) ([]core.Event, ipldformat.N
 		if err != nil {
 			return nil, nil, err
 		}
-		revents.Patches[i] = patchEvent{
+		pe := patchEvent{
 			Timestamp: time.Now(),
 			ID:        actions[i].EntityID,
 			ModelName: actions[i].ModelName,
 			Patch:     *op,
 		}
+		if jp.privKey != nil {
+			if err := jp.sign(&pe); err != nil {
+				return nil, nil, err
+			}
+		}
+		revents.Patches[i] = pe
 		events[i] = revents.Patches[i]
 	}
 
@@ -91,6 +246,23 @@ func (jp *jsonPatcher) Create(actions []core.Action) ([]core.Event, ipldformat.N
 	return events, n, nil
 }
 
+// entityKey identifies the (Model, EntityID) pair events are grouped by
+// when resolving concurrent branches.
+type entityKey struct {
+	model    string
+	entityID string
+}
+
+// Reduce applies events to the datastore. Events are first grouped by
+// entity: a group with more than one event means the caller observed
+// concurrent branches for that entity (e.g. two heads merged into one log
+// visit), and is resolved deterministically before being applied. Reduce
+// has no causal parent links to order a group by — it only sees the flat
+// events handed to it in this call, with no indication of which happened
+// before which other than Timestamp — so disambiguation within a group
+// falls back to (Timestamp, event CID) and concurrent saves are applied
+// sequentially in that order (last-write-wins per field), not merged via
+// a true three-way diff against a common ancestor.
 func (jp *jsonPatcher) Reduce(events []core.Event, datastore ds.TxnDatastore, baseKey ds.Key) ([]core.ReduceAction, error) {
 	txn, err := datastore.NewTransaction(false)
 	if err != nil {
@@ -98,63 +270,555 @@ func (jp *jsonPatcher) Reduce(events []core.Event, datastore ds.TxnDatastore, ba
 	}
 	defer txn.Discard()
 
-	actions := make([]core.ReduceAction, len(events))
+	jes := make([]patchEvent, len(events))
+	cids := make([]cid.Cid, len(events))
+	order := make([]entityKey, 0, len(events))
+	groups := make(map[entityKey][]int)
 	for i, e := range events {
 		je, ok := e.(patchEvent)
 		if !ok {
 			return nil, fmt.Errorf("event unrecognized for jsonpatcher eventcodec")
 		}
-		key := baseKey.ChildString(e.Model()).ChildString(e.EntityID().String())
-		switch je.Patch.Type {
-		case create:
-			exist, err := txn.Has(key)
-			if err != nil {
+		if je.Patch.Author != nil {
+			if err := verify(je); err != nil {
 				return nil, err
 			}
-			if exist {
-				return nil, errCantCreateExistingInstance
+			if jp.acl != nil && !jp.acl(je.Patch.Author, e.Model(), e.EntityID()) {
+				return nil, errUnauthorizedAuthor
 			}
-			if err := txn.Put(key, je.Patch.JSONPatch); err != nil {
-				return nil, fmt.Errorf("error when reducing create event: %v", err)
+		} else if jp.privKey != nil || jp.acl != nil {
+			// A codec built with NewSigned, or one with an ACL configured,
+			// requires every event to carry a verifiable author: an
+			// unsigned event can't be checked against the ACL at all, so
+			// letting it through would silently bypass both.
+			return nil, errUnsignedEvent
+		}
+		c, err := eventCid(je)
+		if err != nil {
+			return nil, err
+		}
+		jes[i], cids[i] = je, c
+
+		k := entityKey{model: e.Model(), entityID: e.EntityID().String()}
+		if _, seen := groups[k]; !seen {
+			order = append(order, k)
+		}
+		groups[k] = append(groups[k], i)
+	}
+
+	// Conflicts are accumulated locally for the duration of this call and
+	// only published to jp.conflicts once, at the end: resolveGroup used
+	// to append straight into that shared field, which raced against any
+	// other goroutine reading or writing it via a concurrent Reduce or
+	// Conflicts() call.
+	var actions []core.ReduceAction
+	var conflicts []Conflict
+	for _, k := range order {
+		resolved, groupConflicts := jp.resolveGroup(k, jes, cids, groups[k])
+		conflicts = append(conflicts, groupConflicts...)
+		for _, r := range resolved {
+			je := jes[r.idx]
+			action, err := jp.applyEvent(txn, baseKey, je)
+			if err != nil {
+				// A JSONPatch-format save with concurrent sibling saves in
+				// its group can carry index-based ops (removes,
+				// reorders) that are only valid against the base it was
+				// diffed from, and can fail to apply once an earlier
+				// sibling in the same group has already mutated the
+				// document. That's an expected hazard of sequential
+				// last-write-wins application, not a corrupt event, so
+				// it's dropped as a conflict instead of aborting the
+				// whole Reduce call.
+				if r.concurrentSave && je.Patch.Type == save && je.Patch.Format == JSONPatch {
+					conflicts = append(conflicts, Conflict{
+						Model: k.model, EntityID: je.EntityID(),
+						Type: ConflictFieldMerge, Discarded: []cid.Cid{cids[r.idx]},
+					})
+					log.Debug(fmt.Sprintf("\tdropping concurrent save that failed to apply: %v", err))
+					continue
+				}
+				return nil, err
 			}
-			actions[i] = core.ReduceAction{Type: core.Create, Model: e.Model(), EntityID: e.EntityID()}
-			log.Debug("\tcreate operation applied")
-		case save:
-			value, err := txn.Get(key)
-			if errors.Is(err, ds.ErrNotFound) {
-				return nil, errSavingNonExistentInstance
+			actions = append(actions, action)
+		}
+	}
+	if err := txn.Commit(); err != nil {
+		return nil, err
+	}
+
+	jp.conflictsMu.Lock()
+	jp.conflicts = conflicts
+	jp.conflictsMu.Unlock()
+
+	return actions, nil
+}
+
+// CompactedEntity identifies an entity Compact wrote a snapshot for. Every
+// earlier block in the thread log whose events for (Model, EntityID) all
+// predate OlderThan is superseded by that snapshot and is safe for the
+// caller to garbage collect; this package has no access to the log itself
+// to do that pruning directly.
+type CompactedEntity struct {
+	Model     string
+	EntityID  core.EntityID
+	OlderThan time.Time
+}
+
+// Compact builds a snapshot event for every entity currently stored under
+// baseKey. Reduce already folds every create/save/delete into that single
+// value, so the snapshot doesn't need to replay anything: it's just that
+// value re-wrapped with a Timestamp as of right now — the live value can
+// already reflect saves timestamped after olderThan, so stamping the
+// snapshot with olderThan itself would make resolveGroup think those
+// saves are still unapplied and replay them again on top of a body that
+// already contains their effect. olderThan doesn't select which entities
+// get a snapshot (every stored entity does) and isn't the snapshot's own
+// as-of time; it's only passed through as each CompactedEntity's OlderThan.
+// Callers append the returned record to the thread log; the returned
+// CompactedEntity list tells them which (Model, EntityID) pairs are now
+// covered by a snapshot, so they can mark every earlier block for those
+// entities as superseded and garbage collect it once the snapshot has
+// propagated to every replica. Reduce treats a snapshot as authoritative
+// on replay, but still replays any save/delete whose Timestamp is after
+// the snapshot's.
+func (jp *jsonPatcher) Compact(datastore ds.TxnDatastore, baseKey ds.Key, olderThan time.Time) ([]core.Event, ipldformat.Node, []CompactedEntity, error) {
+	txn, err := datastore.NewTransaction(true)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	defer txn.Discard()
+
+	results, err := txn.Query(dsq.Query{Prefix: baseKey.String()})
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	defer results.Close()
+
+	asOf := time.Now()
+	var patches []patchEvent
+	var superseded []CompactedEntity
+	for entry := range results.Next() {
+		if entry.Error != nil {
+			return nil, nil, nil, entry.Error
+		}
+		key := ds.NewKey(entry.Key)
+		namespaces := key.Namespaces()
+		if len(namespaces) < 2 {
+			continue
+		}
+		model := namespaces[len(namespaces)-2]
+		id := core.EntityID(namespaces[len(namespaces)-1])
+
+		patches = append(patches, patchEvent{
+			Timestamp: asOf,
+			ID:        id,
+			ModelName: model,
+			Patch: operation{
+				Type:      snapshot,
+				EntityID:  id,
+				JSONPatch: entry.Value,
+			},
+		})
+		superseded = append(superseded, CompactedEntity{Model: model, EntityID: id, OlderThan: olderThan})
+	}
+
+	revents := recordEvents{CodecVersion: codecVersion, Patches: patches}
+	events := make([]core.Event, len(patches))
+	for i := range patches {
+		if jp.privKey != nil {
+			if err := jp.sign(&revents.Patches[i]); err != nil {
+				return nil, nil, nil, err
 			}
+			patches[i] = revents.Patches[i]
+		}
+		events[i] = revents.Patches[i]
+	}
+
+	n, err := cbornode.WrapObject(revents, multihash.SHA2_256, -1)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return events, n, superseded, nil
+}
+
+// MigrationReport summarizes what Migrate did, or would do in dry-run
+// mode: how many entities were touched per model, and which ones the
+// target codec can't represent losslessly (e.g. a signed event migrated
+// to an unsigned codec loses its Author/Sig).
+type MigrationReport struct {
+	PerModel map[string]int
+	Lossy    []string
+}
+
+// Migrate re-encodes every entity currently materialized under baseKey
+// from `from` to `to`, rewriting the datastore in place. It migrates only
+// each entity's current value, not its save history: this datastore only
+// ever holds materialized current state, and the history of creates,
+// saves and deletes that produced it lives in the thread log, which
+// Migrate has no access to. An entity's history is therefore not
+// preserved across the migration, even though its latest value is. In
+// dryRun mode the datastore isn't touched; the returned report alone
+// tells the operator what upgrading would cost.
+func Migrate(ctx context.Context, from, to core.EventCodec, datastore ds.TxnDatastore, baseKey ds.Key, dryRun bool) (*MigrationReport, error) {
+	txn, err := datastore.NewTransaction(true)
+	if err != nil {
+		return nil, err
+	}
+	defer txn.Discard()
+
+	results, err := txn.Query(dsq.Query{Prefix: baseKey.String()})
+	if err != nil {
+		return nil, err
+	}
+	defer results.Close()
+
+	fromSigned, toSigned := isSigned(from), isSigned(to)
+	report := &MigrationReport{PerModel: make(map[string]int)}
+	for entry := range results.Next() {
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+		if entry.Error != nil {
+			return nil, entry.Error
+		}
+
+		key := ds.NewKey(entry.Key)
+		namespaces := key.Namespaces()
+		if len(namespaces) < 2 {
+			continue
+		}
+		model := namespaces[len(namespaces)-2]
+		id := core.EntityID(namespaces[len(namespaces)-1])
+		report.PerModel[model]++
+
+		if fromSigned && !toSigned {
+			report.Lossy = append(report.Lossy, fmt.Sprintf("%s/%s: signature and author would be dropped", model, id))
+		}
+		if dryRun {
+			continue
+		}
+
+		events, _, err := to.Create([]core.Action{{
+			Type:      core.Create,
+			ModelName: model,
+			EntityID:  id,
+			Current:   currentFor(to, entry.Value),
+		}})
+		if err != nil {
+			return nil, fmt.Errorf("re-encoding %s/%s: %v", model, id, err)
+		}
+
+		// to.Reduce's create case refuses to overwrite an existing key, so
+		// the old value for this entity has to go first. When `to` is this
+		// package's own codec, do the delete and the rewrite in a single
+		// transaction via applyEvent directly, instead of going through the
+		// public Create+Reduce path in two separately-committed
+		// transactions: a failure (or a crash) between the two would
+		// otherwise delete the entity and never recreate it.
+		if toJP, ok := to.(*jsonPatcher); ok {
+			rwTxn, err := datastore.NewTransaction(false)
 			if err != nil {
 				return nil, err
 			}
-			patchedValue, err := jsonpatch.MergePatch(value, je.Patch.JSONPatch)
-			if err != nil {
-				return nil, fmt.Errorf("error when reducing save event: %v", err)
+			if err := rwTxn.Delete(key); err != nil {
+				rwTxn.Discard()
+				return nil, err
 			}
-			if err = txn.Put(key, patchedValue); err != nil {
+			if _, err := toJP.applyEvent(rwTxn, baseKey, events[0].(patchEvent)); err != nil {
+				rwTxn.Discard()
+				return nil, fmt.Errorf("rewriting %s/%s: %v", model, id, err)
+			}
+			if err := rwTxn.Commit(); err != nil {
 				return nil, err
 			}
-			actions[i] = core.ReduceAction{Type: core.Save, Model: e.Model(), EntityID: e.EntityID()}
-			log.Debug("\tsave operation applied")
+			continue
+		}
+
+		// A foreign core.EventCodec manages its own transaction inside
+		// Reduce, so the delete can't be folded into it; this is the best
+		// atomicity available across an arbitrary implementation.
+		delTxn, err := datastore.NewTransaction(false)
+		if err != nil {
+			return nil, err
+		}
+		if err := delTxn.Delete(key); err != nil {
+			delTxn.Discard()
+			return nil, err
+		}
+		if err := delTxn.Commit(); err != nil {
+			return nil, err
+		}
+		if _, err := to.Reduce(events, datastore, baseKey); err != nil {
+			return nil, fmt.Errorf("rewriting %s/%s: %v", model, id, err)
+		}
+	}
+	return report, nil
+}
+
+func isSigned(codec core.EventCodec) bool {
+	jp, ok := codec.(*jsonPatcher)
+	return ok && jp.privKey != nil
+}
+
+// currentFor builds the core.Action.Current value Create expects for raw,
+// given codec's jsonMode. json.RawMessage round-trips a non-jsonMode
+// codec's arbitrary document without re-encoding it.
+func currentFor(codec core.EventCodec, raw []byte) interface{} {
+	if jp, ok := codec.(*jsonPatcher); ok && jp.jsonMode {
+		s := string(raw)
+		return &s
+	}
+	return json.RawMessage(raw)
+}
+
+// resolvedEvent is one event resolveGroup decided should be applied, in
+// order. concurrentSave marks every save in a group that holds more than
+// one save (the first in (Timestamp, CID) order included): Reduce treats a
+// JSONPatch-format apply failure on one of these as an expected conflict
+// rather than a fatal error, since the patch was diffed against a base
+// that a sibling may have already mutated.
+type resolvedEvent struct {
+	idx            int
+	concurrentSave bool
+}
+
+func resolvedIdx(idx int) resolvedEvent { return resolvedEvent{idx: idx} }
+
+// sortSaves orders saves by (Timestamp, CID) ascending, the deterministic
+// stand-in this package uses for causal order when it has no parent
+// links to consult.
+func sortSaves(saves []int, jes []patchEvent, cids []cid.Cid) {
+	sort.Slice(saves, func(a, b int) bool {
+		ia, ib := saves[a], saves[b]
+		if !jes[ia].Timestamp.Equal(jes[ib].Timestamp) {
+			return jes[ia].Timestamp.Before(jes[ib].Timestamp)
+		}
+		return bytes.Compare(cids[ia].Bytes(), cids[ib].Bytes()) < 0
+	})
+}
+
+// resolveGroup decides, and orders, which of the events in idxs should
+// actually be applied for entity k, recording any conflict it had to
+// break. A single-event group always passes through unchanged. Concurrent
+// saves are NOT three-way merged against a common ancestor: they're
+// applied sequentially in (Timestamp, CID) order, so a field touched by
+// more than one of them ends up as whichever wrote last in that order.
+func (jp *jsonPatcher) resolveGroup(k entityKey, jes []patchEvent, cids []cid.Cid, idxs []int) ([]resolvedEvent, []Conflict) {
+	if len(idxs) == 1 {
+		return []resolvedEvent{resolvedIdx(idxs[0])}, nil
+	}
+
+	var conflicts []Conflict
+	var creates, saves, deletes, snapshots []int
+	for _, i := range idxs {
+		switch jes[i].Patch.Type {
+		case create:
+			creates = append(creates, i)
+		case save:
+			saves = append(saves, i)
 		case delete:
-			if err := txn.Delete(key); err != nil {
-				return nil, err
+			deletes = append(deletes, i)
+		case snapshot:
+			snapshots = append(snapshots, i)
+		}
+	}
+
+	if len(snapshots) > 0 {
+		// The snapshot is authoritative as of its own Timestamp, so it
+		// supersedes any create/delete and any save at or before that
+		// time. It is NOT authoritative for events after it: those are
+		// causally later writes and must still be replayed on top,
+		// otherwise a save submitted alongside a snapshot would be
+		// silently lost instead of contributing to the O(events since
+		// last snapshot) replay the request asked for.
+		latest := snapshots[0]
+		for _, i := range snapshots[1:] {
+			if jes[i].Timestamp.After(jes[latest].Timestamp) {
+				latest = i
+			}
+		}
+		var laterSaves, laterDeletes []int
+		for _, i := range saves {
+			if jes[i].Timestamp.After(jes[latest].Timestamp) {
+				laterSaves = append(laterSaves, i)
 			}
-			actions[i] = core.ReduceAction{Type: core.Delete, Model: e.Model(), EntityID: e.EntityID()}
-			log.Debug("\tdelete operation applied")
-		default:
-			return nil, errUnknownOperation
 		}
+		for _, i := range deletes {
+			if jes[i].Timestamp.After(jes[latest].Timestamp) {
+				laterDeletes = append(laterDeletes, i)
+			}
+		}
+		if len(laterDeletes) > 0 && len(laterSaves) > 0 {
+			discarded := make([]cid.Cid, len(laterSaves))
+			for j, i := range laterSaves {
+				discarded[j] = cids[i]
+			}
+			conflicts = append(conflicts, Conflict{
+				Model: k.model, EntityID: jes[laterDeletes[0]].EntityID(),
+				Type: ConflictDeleteWins, Discarded: discarded,
+			})
+			laterSaves = nil
+		}
+		sortSaves(laterSaves, jes, cids)
+		concurrent := len(laterSaves) > 1
+
+		resolved := make([]resolvedEvent, 0, 1+len(laterSaves)+1)
+		resolved = append(resolved, resolvedIdx(latest))
+		for _, i := range laterSaves {
+			resolved = append(resolved, resolvedEvent{idx: i, concurrentSave: concurrent})
+		}
+		if len(laterDeletes) > 0 {
+			resolved = append(resolved, resolvedIdx(laterDeletes[0]))
+		}
+		return resolved, conflicts
 	}
-	if err := txn.Commit(); err != nil {
-		return nil, err
+
+	if len(creates) > 1 {
+		winner := creates[0]
+		var discarded []cid.Cid
+		for _, i := range creates[1:] {
+			if bytes.Compare(jes[i].Patch.JSONPatch, jes[winner].Patch.JSONPatch) < 0 {
+				discarded = append(discarded, cids[winner])
+				winner = i
+			} else {
+				discarded = append(discarded, cids[i])
+			}
+		}
+		conflicts = append(conflicts, Conflict{
+			Model: k.model, EntityID: jes[winner].EntityID(),
+			Type: ConflictConcurrentCreate, Discarded: discarded,
+		})
+		creates = []int{winner}
 	}
 
-	return actions, nil
+	if len(deletes) > 0 && len(saves) > 0 {
+		discarded := make([]cid.Cid, len(saves))
+		for j, i := range saves {
+			discarded[j] = cids[i]
+		}
+		conflicts = append(conflicts, Conflict{
+			Model: k.model, EntityID: jes[deletes[0]].EntityID(),
+			Type: ConflictDeleteWins, Discarded: discarded,
+		})
+		saves = nil
+	} else if len(saves) > 1 {
+		conflicts = append(conflicts, Conflict{
+			Model: k.model, EntityID: jes[saves[0]].EntityID(),
+			Type: ConflictFieldMerge,
+		})
+	}
+	sortSaves(saves, jes, cids)
+	concurrent := len(saves) > 1
+
+	resolved := make([]resolvedEvent, 0, len(creates)+len(saves)+len(deletes))
+	for _, i := range creates {
+		resolved = append(resolved, resolvedIdx(i))
+	}
+	for _, i := range saves {
+		resolved = append(resolved, resolvedEvent{idx: i, concurrentSave: concurrent})
+	}
+	if len(deletes) > 0 {
+		resolved = append(resolved, resolvedIdx(deletes[0]))
+	}
+	return resolved, conflicts
+}
+
+// eventCid returns the CID an event would have as a standalone CBOR block,
+// used only as a deterministic tie-breaker when resolving conflicts.
+func eventCid(je patchEvent) (cid.Cid, error) {
+	n, err := cbornode.WrapObject(je, multihash.SHA2_256, -1)
+	if err != nil {
+		return cid.Undef, err
+	}
+	return n.Cid(), nil
+}
+
+func (jp *jsonPatcher) applyEvent(txn ds.Txn, baseKey ds.Key, je patchEvent) (core.ReduceAction, error) {
+	key := baseKey.ChildString(je.Model()).ChildString(je.EntityID().String())
+	switch je.Patch.Type {
+	case create:
+		exist, err := txn.Has(key)
+		if err != nil {
+			return core.ReduceAction{}, err
+		}
+		if exist {
+			return core.ReduceAction{}, errCantCreateExistingInstance
+		}
+		if err := jp.validate(je.Model(), je.Patch.JSONPatch); err != nil {
+			return core.ReduceAction{}, err
+		}
+		if err := txn.Put(key, je.Patch.JSONPatch); err != nil {
+			return core.ReduceAction{}, fmt.Errorf("error when reducing create event: %v", err)
+		}
+		log.Debug("\tcreate operation applied")
+		return core.ReduceAction{Type: core.Create, Model: je.Model(), EntityID: je.EntityID()}, nil
+	case snapshot:
+		// A snapshot is authoritative: it replaces whatever (if anything)
+		// is currently stored, rather than erroring on a pre-existing key.
+		if err := jp.validate(je.Model(), je.Patch.JSONPatch); err != nil {
+			return core.ReduceAction{}, err
+		}
+		if err := txn.Put(key, je.Patch.JSONPatch); err != nil {
+			return core.ReduceAction{}, fmt.Errorf("error when reducing snapshot event: %v", err)
+		}
+		log.Debug("\tsnapshot operation applied")
+		return core.ReduceAction{Type: core.Create, Model: je.Model(), EntityID: je.EntityID()}, nil
+	case save:
+		value, err := txn.Get(key)
+		if errors.Is(err, ds.ErrNotFound) {
+			return core.ReduceAction{}, errSavingNonExistentInstance
+		}
+		if err != nil {
+			return core.ReduceAction{}, err
+		}
+		var patchedValue []byte
+		switch je.Patch.Format {
+		case MergePatch:
+			patchedValue, err = jsonpatch.MergePatch(value, je.Patch.JSONPatch)
+		case JSONPatch:
+			var decoded jsonpatch.Patch
+			decoded, err = jsonpatch.DecodePatch(je.Patch.JSONPatch)
+			if err == nil {
+				patchedValue, err = decoded.Apply(value)
+			}
+		default:
+			err = fmt.Errorf("unknown patch format %d", je.Patch.Format)
+		}
+		if err != nil {
+			return core.ReduceAction{}, fmt.Errorf("error when reducing save event: %v", err)
+		}
+		// Re-validate post-patch: a peer's patch applied on top of our
+		// local state can produce a document neither side would have
+		// created on its own.
+		if err := jp.validate(je.Model(), patchedValue); err != nil {
+			return core.ReduceAction{}, err
+		}
+		if err = txn.Put(key, patchedValue); err != nil {
+			return core.ReduceAction{}, err
+		}
+		log.Debug("\tsave operation applied")
+		return core.ReduceAction{Type: core.Save, Model: je.Model(), EntityID: je.EntityID()}, nil
+	case delete:
+		if err := txn.Delete(key); err != nil {
+			return core.ReduceAction{}, err
+		}
+		log.Debug("\tdelete operation applied")
+		return core.ReduceAction{Type: core.Delete, Model: je.Model(), EntityID: je.EntityID()}, nil
+	default:
+		return core.ReduceAction{}, errUnknownOperation
+	}
 }
 
+// codecVersion is stamped on every recordEvents block this package writes,
+// so a future codec (e.g. one emitted by Migrate) can tell which on-disk
+// format it's looking at without guessing from the fields present.
+const codecVersion = 1
+
 type recordEvents struct {
-	Patches []patchEvent
+	// CodecVersion identifies the jsonpatcher format this block was
+	// written with.
+	CodecVersion int
+	Patches      []patchEvent
 }
 
 // EventsFromBytes returns a unmarshaled event from its bytes representation
@@ -172,10 +836,10 @@ func (jp *jsonPatcher) EventsFromBytes(data []byte) ([]core.Event, error) {
 	return res, nil
 }
 
-func createEvent(id core.EntityID, v interface{}, jsonMode bool) (*operation, error) {
+func (jp *jsonPatcher) createEvent(modelName string, id core.EntityID, v interface{}) (*operation, error) {
 	var opBytes []byte
 
-	if jsonMode {
+	if jp.jsonMode {
 		strjson := v.(*string)
 		opBytes = []byte(*strjson)
 	} else {
@@ -185,6 +849,9 @@ func createEvent(id core.EntityID, v interface{}, jsonMode bool) (*operation, er
 			return nil, err
 		}
 	}
+	if err := jp.validate(modelName, opBytes); err != nil {
+		return nil, err
+	}
 	return &operation{
 		Type:      create,
 		EntityID:  id,
@@ -192,9 +859,9 @@ func createEvent(id core.EntityID, v interface{}, jsonMode bool) (*operation, er
 	}, nil
 }
 
-func saveEvent(id core.EntityID, prev interface{}, curr interface{}, jsonMode bool) (*operation, error) {
+func (jp *jsonPatcher) saveEvent(modelName string, id core.EntityID, prev interface{}, curr interface{}) (*operation, error) {
 	var prevBytes, currBytes []byte
-	if jsonMode {
+	if jp.jsonMode {
 		strCurrJson := curr.(*string)
 
 		prevBytes = prev.([]byte)
@@ -210,14 +877,33 @@ func saveEvent(id core.EntityID, prev interface{}, curr interface{}, jsonMode bo
 			return nil, err
 		}
 	}
-	jsonPatch, err := jsonpatch.CreateMergePatch(prevBytes, currBytes)
+	if err := jp.validate(modelName, currBytes); err != nil {
+		return nil, err
+	}
+
+	var jsonPatch []byte
+	var err error
+	switch jp.patchFormat {
+	case MergePatch:
+		jsonPatch, err = jsonpatch.CreateMergePatch(prevBytes, currBytes)
+	case JSONPatch:
+		var ops jsondiff.Patch
+		ops, err = jsondiff.CompareJSON(prevBytes, currBytes)
+		if err == nil {
+			jsonPatch, err = json.Marshal(ops)
+		}
+	default:
+		err = fmt.Errorf("unknown patch format %d", jp.patchFormat)
+	}
 	if err != nil {
 		return nil, err
 	}
+
 	return &operation{
 		Type:      save,
 		EntityID:  id,
 		JSONPatch: jsonPatch,
+		Format:    jp.patchFormat,
 	}, nil
 }
 
@@ -229,6 +915,60 @@ func deleteEvent(id core.EntityID) (*operation, error) {
 	}, nil
 }
 
+// sign attaches jp's public key as the event's author and a signature over
+// its ModelName, ID, operation payload and timestamp, so that Reduce can later attribute
+// and authenticate it.
+func (jp *jsonPatcher) sign(pe *patchEvent) error {
+	pubKeyBytes, err := crypto.MarshalPublicKey(jp.privKey.GetPublic())
+	if err != nil {
+		return err
+	}
+	sig, err := jp.privKey.Sign(signedPayload(pubKeyBytes, pe))
+	if err != nil {
+		return err
+	}
+	pe.Patch.Author = pubKeyBytes
+	pe.Patch.Sig = sig
+	return nil
+}
+
+// verify checks that je.Patch.Sig is a valid signature by je.Patch.Author
+// over je's ModelName, ID, operation payload and timestamp.
+func verify(je patchEvent) error {
+	pubKey, err := crypto.UnmarshalPublicKey(je.Patch.Author)
+	if err != nil {
+		return fmt.Errorf("unmarshaling event author: %v", err)
+	}
+	ok, err := pubKey.Verify(signedPayload(je.Patch.Author, &je), je.Patch.Sig)
+	if err != nil {
+		return fmt.Errorf("verifying event signature: %v", err)
+	}
+	if !ok {
+		return errInvalidSignature
+	}
+	return nil
+}
+
+// signedPayload builds the byte sequence that's actually signed. It must
+// cover every field Reduce uses to route or authorize the event —
+// ModelName and ID (what the entity-grouping key, the ACL call, and the
+// datastore key all resolve through), not just the fields nested under
+// Patch — otherwise an event can be re-targeted to a different model or
+// entity after signing without invalidating its signature. Author is
+// passed in explicitly since it's set on the operation only after signing.
+func signedPayload(author []byte, pe *patchEvent) []byte {
+	buf := new(bytes.Buffer)
+	buf.Write(author)
+	buf.WriteString(pe.ModelName)
+	buf.WriteString(pe.ID.String())
+	_ = binary.Write(buf, binary.BigEndian, int64(pe.Patch.Type))
+	_ = binary.Write(buf, binary.BigEndian, int64(pe.Patch.Format))
+	buf.WriteString(pe.Patch.EntityID.String())
+	buf.Write(pe.Patch.JSONPatch)
+	_ = binary.Write(buf, binary.BigEndian, pe.Timestamp.UnixNano())
+	return buf.Bytes()
+}
+
 type patchEvent struct {
 	Timestamp time.Time
 	ID        core.EntityID
@@ -0,0 +1,75 @@
+package jsonpatcher
+
+import (
+	"testing"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	core "github.com/textileio/go-textile-core/store"
+)
+
+// TestCompactSnapshotTimestampIsAsOfTime reproduces the review's concern:
+// Compact reads the *live* current value (which may already reflect saves
+// timestamped after the caller's olderThan cutoff), so stamping the
+// snapshot with olderThan makes those saves look like they happened after
+// the snapshot. Replaying the snapshot plus the original save must not
+// double-apply it.
+func TestCompactSnapshotTimestampIsAsOfTime(t *testing.T) {
+	jp := &jsonPatcher{patchFormat: JSONPatch}
+	baseKey := ds.NewKey("/thread")
+	store := newMemDatastore()
+
+	createEvents, _, err := jp.Create([]core.Action{{
+		Type: core.Create, ModelName: "thing", EntityID: "id1",
+		Current: map[string]interface{}{"tags": []interface{}{"a"}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := jp.Reduce(createEvents, store, baseKey); err != nil {
+		t.Fatal(err)
+	}
+
+	saveEvents, _, err := jp.Create([]core.Action{{
+		Type: core.Save, ModelName: "thing", EntityID: "id1",
+		Previous: map[string]interface{}{"tags": []interface{}{"a"}},
+		Current:  map[string]interface{}{"tags": []interface{}{"a", "b"}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	saveTimestamp := saveEvents[0].(patchEvent).Timestamp
+	if _, err := jp.Reduce(saveEvents, store, baseKey); err != nil {
+		t.Fatal(err)
+	}
+
+	// A cutoff earlier than the save that already landed in the live
+	// value being snapshotted.
+	olderThan := saveTimestamp.Add(-time.Hour)
+	compactEvents, _, _, err := jp.Compact(store, baseKey, olderThan)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(compactEvents) != 1 {
+		t.Fatalf("expected one snapshot event, got %d", len(compactEvents))
+	}
+	snapshot := compactEvents[0].(patchEvent)
+	if !snapshot.Timestamp.After(saveTimestamp) {
+		t.Fatalf("snapshot timestamp %v must be after the save (%v) it already reflects, so the save isn't replayed again", snapshot.Timestamp, saveTimestamp)
+	}
+
+	// Cold-start replay: a fresh datastore sees the snapshot and the
+	// original save in the same Reduce call.
+	fresh := newMemDatastore()
+	if _, err := jp.Reduce([]core.Event{snapshot, saveEvents[0]}, fresh, baseKey); err != nil {
+		t.Fatal(err)
+	}
+	got, err := fresh.Get(baseKey.ChildString("thing").ChildString("id1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"tags":["a","b"]}`
+	if string(got) != want {
+		t.Fatalf("replaying snapshot+save double-applied the save: got %s, want %s", got, want)
+	}
+}
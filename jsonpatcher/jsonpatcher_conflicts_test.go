@@ -0,0 +1,53 @@
+package jsonpatcher
+
+import (
+	"testing"
+
+	ds "github.com/ipfs/go-datastore"
+	core "github.com/textileio/go-textile-core/store"
+)
+
+// TestConflictsReflectsOnlyTheMostRecentReduce guards the fix for
+// jp.conflicts being published as one slice at the end of Reduce rather
+// than mutated in place by resolveGroup: a Reduce call that resolves no
+// conflicts must clear out whatever a previous call left behind, not
+// leave it for Conflicts() to report stale.
+func TestConflictsReflectsOnlyTheMostRecentReduce(t *testing.T) {
+	jp := &jsonPatcher{patchFormat: JSONPatch}
+	baseKey := ds.NewKey("/thread")
+	store := newMemDatastore()
+
+	createEvents, _, err := jp.Create([]core.Action{{
+		Type: core.Create, ModelName: "thing", EntityID: "id1",
+		Current: map[string]interface{}{"name": "a"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ce := createEvents[0].(patchEvent)
+	dup := ce
+	dup.Patch.JSONPatch = []byte(`{"name":"b"}`)
+
+	if _, err := jp.Reduce([]core.Event{ce, dup}, store, baseKey); err != nil {
+		t.Fatal(err)
+	}
+	conflicts := jp.Conflicts()
+	if len(conflicts) != 1 || conflicts[0].Type != ConflictConcurrentCreate {
+		t.Fatalf("expected one ConflictConcurrentCreate, got %v", conflicts)
+	}
+
+	saveEvents, _, err := jp.Create([]core.Action{{
+		Type: core.Save, ModelName: "thing", EntityID: "id1",
+		Previous: map[string]interface{}{"name": "a"},
+		Current:  map[string]interface{}{"name": "c"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := jp.Reduce(saveEvents, store, baseKey); err != nil {
+		t.Fatal(err)
+	}
+	if conflicts := jp.Conflicts(); len(conflicts) != 0 {
+		t.Fatalf("a Reduce call with no conflicts must not leave the previous call's conflicts behind, got %v", conflicts)
+	}
+}
@@ -0,0 +1,87 @@
+package jsonpatcher
+
+import (
+	"strings"
+	"sync"
+
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+)
+
+// memDatastore is a minimal in-memory ds.TxnDatastore for tests: its
+// transactions commit writes immediately and aren't isolated from each
+// other. It exists only to give Reduce/Compact/Migrate something
+// satisfying ds.TxnDatastore to run against, not to model real
+// transactional isolation.
+type memDatastore struct {
+	data sync.Map // string -> []byte
+}
+
+func newMemDatastore() *memDatastore {
+	return &memDatastore{}
+}
+
+func (m *memDatastore) Get(key ds.Key) ([]byte, error) {
+	v, ok := m.data.Load(key.String())
+	if !ok {
+		return nil, ds.ErrNotFound
+	}
+	return v.([]byte), nil
+}
+
+func (m *memDatastore) Has(key ds.Key) (bool, error) {
+	_, ok := m.data.Load(key.String())
+	return ok, nil
+}
+
+func (m *memDatastore) GetSize(key ds.Key) (int, error) {
+	v, err := m.Get(key)
+	if err != nil {
+		return 0, err
+	}
+	return len(v), nil
+}
+
+func (m *memDatastore) Query(q dsq.Query) (dsq.Results, error) {
+	var entries []dsq.Entry
+	m.data.Range(func(k, v interface{}) bool {
+		key := k.(string)
+		if q.Prefix == "" || strings.HasPrefix(key, q.Prefix) {
+			entries = append(entries, dsq.Entry{Key: key, Value: v.([]byte)})
+		}
+		return true
+	})
+	return dsq.ResultsWithEntries(q, entries), nil
+}
+
+func (m *memDatastore) Put(key ds.Key, value []byte) error {
+	m.data.Store(key.String(), value)
+	return nil
+}
+
+func (m *memDatastore) Delete(key ds.Key) error {
+	m.data.Delete(key.String())
+	return nil
+}
+
+func (m *memDatastore) Sync(ds.Key) error { return nil }
+func (m *memDatastore) Close() error      { return nil }
+
+func (m *memDatastore) NewTransaction(readOnly bool) (ds.Txn, error) {
+	return &memTxn{ds: m}, nil
+}
+
+type memTxn struct {
+	ds *memDatastore
+}
+
+func (t *memTxn) Get(key ds.Key) ([]byte, error)         { return t.ds.Get(key) }
+func (t *memTxn) Has(key ds.Key) (bool, error)           { return t.ds.Has(key) }
+func (t *memTxn) GetSize(key ds.Key) (int, error)        { return t.ds.GetSize(key) }
+func (t *memTxn) Query(q dsq.Query) (dsq.Results, error) { return t.ds.Query(q) }
+func (t *memTxn) Put(key ds.Key, value []byte) error     { return t.ds.Put(key, value) }
+func (t *memTxn) Delete(key ds.Key) error                { return t.ds.Delete(key) }
+func (t *memTxn) Commit() error                          { return nil }
+func (t *memTxn) Discard()                               {}
+
+var _ ds.TxnDatastore = (*memDatastore)(nil)
@@ -0,0 +1,55 @@
+package jsonpatcher
+
+import (
+	"context"
+	"testing"
+
+	ds "github.com/ipfs/go-datastore"
+	core "github.com/textileio/go-textile-core/store"
+)
+
+// TestMigrateFailureLeavesOriginalValue checks that a migration the
+// target codec rejects leaves the entity's original value in place. Here
+// the target schema makes to.Create fail while re-encoding, before
+// Migrate deletes anything; the test doesn't reach a failure inside the
+// delete-and-rewrite transaction itself, which memDatastore couldn't roll
+// back anyway.
+func TestMigrateFailureLeavesOriginalValue(t *testing.T) {
+	from := New(false, JSONPatch).(*jsonPatcher)
+	baseKey := ds.NewKey("/thread")
+	store := newMemDatastore()
+
+	createEvents, _, err := from.Create([]core.Action{{
+		Type: core.Create, ModelName: "thing", EntityID: "id1",
+		Current: map[string]interface{}{"name": "a"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := from.Reduce(createEvents, store, baseKey); err != nil {
+		t.Fatal(err)
+	}
+
+	to := New(false, JSONPatch).(*jsonPatcher)
+	if err := to.RegisterSchema("thing", []byte(`{"type":"object","required":["missing"]}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	key := baseKey.ChildString("thing").ChildString("id1")
+	before, err := store.Get(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Migrate(context.Background(), from, to, store, baseKey, false); err == nil {
+		t.Fatal("expected Migrate to fail: the target schema rejects the re-encoded value")
+	}
+
+	after, err := store.Get(key)
+	if err != nil {
+		t.Fatalf("entity must still exist after a failed migration, got: %v", err)
+	}
+	if string(after) != string(before) {
+		t.Fatalf("a failed migration must leave the original value untouched: got %s, want %s", after, before)
+	}
+}
@@ -0,0 +1,50 @@
+package jsonpatcher
+
+import (
+	"errors"
+	"testing"
+)
+
+// TestRegisterSchemaRejectsViolatingDocuments covers two of the points
+// RegisterSchema's doc comment claims: createEvent validates a new
+// document against the registered schema, and saveEvent validates the
+// document the save would produce, before either packs an event.
+func TestRegisterSchemaRejectsViolatingDocuments(t *testing.T) {
+	jp := &jsonPatcher{patchFormat: JSONPatch}
+	if err := jp.RegisterSchema("thing", []byte(`{
+		"type": "object",
+		"required": ["name"],
+		"properties": {"name": {"type": "string"}}
+	}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := jp.createEvent("thing", "id1", map[string]interface{}{"age": 1}); err == nil {
+		t.Fatal("createEvent should reject a document missing the required \"name\" field")
+	} else {
+		var schemaErr *ErrSchemaViolation
+		if !errors.As(err, &schemaErr) {
+			t.Fatalf("expected an *ErrSchemaViolation, got %T: %v", err, err)
+		}
+		if schemaErr.Model != "thing" {
+			t.Fatalf("ErrSchemaViolation.Model = %q, want %q", schemaErr.Model, "thing")
+		}
+	}
+
+	if _, err := jp.createEvent("thing", "id1", map[string]interface{}{"name": "widget"}); err != nil {
+		t.Fatalf("createEvent should accept a document satisfying the schema: %v", err)
+	}
+
+	if _, err := jp.saveEvent("thing", "id1", map[string]interface{}{"name": "widget"}, map[string]interface{}{"age": 2}); err == nil {
+		t.Fatal("saveEvent should reject a resulting document missing the required \"name\" field")
+	}
+
+	if _, err := jp.saveEvent("thing", "id1", map[string]interface{}{"name": "widget"}, map[string]interface{}{"name": "gadget"}); err != nil {
+		t.Fatalf("saveEvent should accept a resulting document satisfying the schema: %v", err)
+	}
+
+	// A model with no registered schema is never validated.
+	if _, err := jp.createEvent("other", "id2", map[string]interface{}{"whatever": true}); err != nil {
+		t.Fatalf("createEvent for a model with no registered schema should never fail validation: %v", err)
+	}
+}
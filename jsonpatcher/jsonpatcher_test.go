@@ -0,0 +1,147 @@
+package jsonpatcher
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"testing"
+
+	ds "github.com/ipfs/go-datastore"
+	libp2pcrypto "github.com/libp2p/go-libp2p-core/crypto"
+	core "github.com/textileio/go-textile-core/store"
+)
+
+// TestSignedPayloadCoversRouting ensures a signed event can't be
+// re-targeted to a different model or entity after signing: ModelName
+// and ID are what Reduce actually keys, ACLs, and writes through, so they
+// must be part of what's signed, not just the fields nested under Patch.
+func TestSignedPayloadCoversRouting(t *testing.T) {
+	priv, _, err := libp2pcrypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jp := &jsonPatcher{privKey: priv}
+	pe := patchEvent{
+		ID:        "alice-private-note",
+		ModelName: "public_notes",
+		Patch:     operation{Type: save, EntityID: "alice-private-note", JSONPatch: []byte(`{}`)},
+	}
+	if err := jp.sign(&pe); err != nil {
+		t.Fatal(err)
+	}
+
+	pe.ModelName = "admin_settings"
+	pe.ID = "victim-entity-id"
+	if err := verify(pe); err == nil {
+		t.Fatal("verify accepted an event retargeted to a different model/entity after signing")
+	}
+}
+
+// TestReduceRejectsUnsignedEventOnSignedCodec covers the companion case:
+// a codec that requires signing must reject an event with no author at
+// all, not just one whose signature fails to verify.
+func TestReduceRejectsUnsignedEventOnSignedCodec(t *testing.T) {
+	priv, _, err := libp2pcrypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jp := &jsonPatcher{privKey: priv}
+	je := patchEvent{
+		ID:        "id1",
+		ModelName: "thing",
+		Patch:     operation{Type: create, EntityID: "id1", JSONPatch: []byte(`{}`)},
+	}
+	if _, err := jp.Reduce([]core.Event{je}, newMemDatastore(), ds.NewKey("/thread")); err != errUnsignedEvent {
+		t.Fatalf("Reduce on a signed codec with an unsigned event: got %v, want errUnsignedEvent", err)
+	}
+}
+
+// TestSaveEventArrayReorderAndDelete covers the behavior a Merge Patch
+// (RFC 7396) can't express at the element level: it only ever replaces an
+// array wholesale, so a reorder or a single-element deletion produces the
+// same kind of patch as rewriting the whole array from scratch. JSON
+// Patch (RFC 6902) can describe the change as ops against individual
+// array indices instead.
+func TestSaveEventArrayReorderAndDelete(t *testing.T) {
+	prev := map[string]interface{}{
+		"tags": []interface{}{"a", "b", "c"},
+	}
+	curr := map[string]interface{}{
+		// "b" is deleted and the remaining tags are reordered.
+		"tags": []interface{}{"c", "a"},
+	}
+
+	mergeJP := &jsonPatcher{patchFormat: MergePatch}
+	mergeOp, err := mergeJP.saveEvent("thing", "id1", prev, curr)
+	if err != nil {
+		t.Fatalf("MergePatch saveEvent: %v", err)
+	}
+
+	var mergePatch map[string]interface{}
+	if err := json.Unmarshal(mergeOp.JSONPatch, &mergePatch); err != nil {
+		t.Fatalf("unmarshal merge patch: %v", err)
+	}
+	gotTags, ok := mergePatch["tags"].([]interface{})
+	if !ok {
+		t.Fatalf("merge patch doesn't carry a replacement tags array: %v", mergePatch)
+	}
+	wantTags := curr["tags"].([]interface{})
+	if len(gotTags) != len(wantTags) {
+		t.Fatalf("merge patch for tags = %v, want the whole replacement array %v", gotTags, wantTags)
+	}
+
+	jsonPatchJP := &jsonPatcher{patchFormat: JSONPatch}
+	jpOp, err := jsonPatchJP.saveEvent("thing", "id1", prev, curr)
+	if err != nil {
+		t.Fatalf("JSONPatch saveEvent: %v", err)
+	}
+
+	var ops []map[string]interface{}
+	if err := json.Unmarshal(jpOp.JSONPatch, &ops); err != nil {
+		t.Fatalf("unmarshal json patch ops: %v", err)
+	}
+	if len(ops) == 0 {
+		t.Fatal("expected at least one JSON Patch op for the tags change")
+	}
+	var sawElementOp bool
+	for _, op := range ops {
+		path, _ := op["path"].(string)
+		if len(path) > len("/tags/") && path[:len("/tags/")] == "/tags/" {
+			sawElementOp = true
+			break
+		}
+	}
+	if !sawElementOp {
+		t.Fatalf("expected a JSON Patch op addressing an individual /tags/N element, got %v", ops)
+	}
+}
+
+// TestSaveEventMergePatchDrop documents that a Merge Patch representing a
+// field removal carries an explicit JSON null for that key rather than
+// omitting it, since RFC 7396 defines null as the deletion marker.
+func TestSaveEventMergePatchDrop(t *testing.T) {
+	prev := map[string]interface{}{
+		"name":  "widget",
+		"notes": "temporary",
+	}
+	curr := map[string]interface{}{
+		"name": "widget",
+	}
+
+	jp := &jsonPatcher{patchFormat: MergePatch}
+	op, err := jp.saveEvent("thing", "id1", prev, curr)
+	if err != nil {
+		t.Fatalf("saveEvent: %v", err)
+	}
+
+	var patch map[string]interface{}
+	if err := json.Unmarshal(op.JSONPatch, &patch); err != nil {
+		t.Fatalf("unmarshal merge patch: %v", err)
+	}
+	v, ok := patch["notes"]
+	if !ok {
+		t.Fatalf("merge patch for a deleted field should still mention the key, got %v", patch)
+	}
+	if v != nil {
+		t.Fatalf("merge patch for a deleted field should set it to null, got %v", v)
+	}
+}